@@ -0,0 +1,117 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"strings"
+
+	cp "github.com/andyleap/parser"
+	semistruct "github.com/awakenetworks/semistruct-parser"
+	"github.com/coreos/go-systemd/journal"
+)
+
+const (
+	// defaultSentinel and defaultGrammarName reproduce the driver's
+	// original, hard-coded behavior when neither the sentinel nor
+	// grammar log-opt is set.
+	defaultSentinel    = "!<"
+	defaultGrammarName = "semistruct"
+
+	// maxSentinelLen keeps the sniffed prefix short and cheap to check
+	// against every line.
+	maxSentinelLen = 8
+)
+
+// grammarParser is the contract a named, pluggable log grammar implements:
+// pull a priority, tags and attributes out of a sentinel-gated line.
+type grammarParser interface {
+	Parse(line string) (journal.Priority, []string, map[string]string, error)
+}
+
+// grammars holds the built-in grammars a `grammar` log-opt can select,
+// keyed by name.
+var grammars = map[string]grammarParser{}
+
+func init() {
+	grammars[defaultGrammarName] = semistructGrammar{parser: semistruct.NewLogParser()}
+	grammars["ltsv"] = ltsvGrammar{}
+	grammars["gelf-short"] = gelfShortGrammar{}
+}
+
+// semistructGrammar wraps the original andyleap/parser grammar built by
+// the vendored semistruct-parser package.
+type semistructGrammar struct {
+	parser *cp.Grammar
+}
+
+func (g semistructGrammar) Parse(line string) (journal.Priority, []string, map[string]string, error) {
+	parsed, err := g.parser.ParseString(line)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if parsed == nil {
+		return 0, nil, nil, errNoMatch
+	}
+
+	res, ok := parsed.(semistruct.Log)
+	if !ok {
+		return 0, nil, nil, errNoMatch
+	}
+
+	return journal.Priority(res.Priority), res.Tags, res.Attrs, nil
+}
+
+// ltsvGrammar parses Labeled Tab-separated Values: TAB-separated
+// "label:value" pairs, e.g. "time:...\thost:...\tlevel:info\tmsg:hello".
+type ltsvGrammar struct{}
+
+func (ltsvGrammar) Parse(line string) (journal.Priority, []string, map[string]string, error) {
+	fields := map[string]interface{}{}
+	for _, tok := range strings.Split(line, "\t") {
+		idx := strings.Index(tok, ":")
+		if idx < 0 {
+			continue
+		}
+		fields[tok[:idx]] = tok[idx+1:]
+	}
+	if len(fields) == 0 {
+		return 0, nil, nil, errNoMatch
+	}
+
+	parsed := normalizeFields(fields)
+	return parsed.Priority, parsed.Tags, parsed.Attrs, nil
+}
+
+// gelfShortGrammar parses a minimal pipe-delimited dialect:
+// "<level>|<comma-separated tags>|<space-separated key=value attrs>",
+// any of the three segments may be empty.
+type gelfShortGrammar struct{}
+
+func (gelfShortGrammar) Parse(line string) (journal.Priority, []string, map[string]string, error) {
+	parts := strings.SplitN(line, "|", 3)
+
+	priority := journal.PriInfo
+	if len(parts) > 0 && parts[0] != "" {
+		priority = priorityFromLevel(parts[0])
+	}
+
+	var tags []string
+	if len(parts) > 1 && parts[1] != "" {
+		tags = strings.Split(parts[1], ",")
+	}
+
+	attrs := map[string]string{}
+	if len(parts) > 2 {
+		for _, tok := range strings.Fields(parts[2]) {
+			k, v, ok := splitLogfmtPair(tok)
+			if !ok {
+				continue
+			}
+			if name, ok := sanitizeFieldName(k); ok {
+				attrs[name] = v
+			}
+		}
+	}
+
+	return priority, tags, attrs, nil
+}
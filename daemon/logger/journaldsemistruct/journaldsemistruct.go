@@ -5,24 +5,30 @@
 package journaldsemistruct
 
 import (
-	"errors"
 	"fmt"
 	"github.com/Sirupsen/logrus"
-	cp "github.com/andyleap/parser"
-	semistruct "github.com/awakenetworks/semistruct-parser"
 	"github.com/coreos/go-systemd/journal"
 	"github.com/docker/docker/daemon/logger"
 	"github.com/docker/docker/daemon/logger/loggerutils"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const name = "journald-semistruct"
 
 type journald struct {
-	vars    map[string]string // additional variables and values to send to the journal along with the log message
-	readers readerList
-	parser  *cp.Grammar
+	// ordinal must stay first in the struct: sync/atomic requires 64-bit
+	// fields accessed atomically to be 64-bit aligned, which isn't
+	// guaranteed for later struct fields on 32-bit platforms.
+	ordinal     uint64            // atomic counter, incremented per message sent
+	vars        map[string]string // additional variables and values to send to the journal along with the log message
+	readers     readerList
+	parser      LineParser
+	containerID string
+	epoch       string // random per-instance id; paired with ordinal for a total order across restarts
 }
 
 type readerList struct {
@@ -58,11 +64,27 @@ func New(ctx logger.Context) (logger.Logger, error) {
 		return nil, err
 	}
 
+	// SYSLOG_IDENTIFIER defaults to the container tag, matching the
+	// stock journald driver, but can be overridden per-container so
+	// existing journalctl/syslog tooling keeps working unchanged.
+	syslogIdentifier := tag
+	if override := ctx.Config["syslog-identifier"]; override != "" {
+		syslogIdentifier = override
+	}
+
 	vars := map[string]string{
 		"CONTAINER_ID":      ctx.ContainerID[:12],
 		"CONTAINER_ID_FULL": ctx.ContainerID,
 		"CONTAINER_NAME":    name,
 		"CONTAINER_TAG":     tag,
+		"SYSLOG_IDENTIFIER": syslogIdentifier,
+	}
+
+	if ctx.ImageName != "" {
+		vars["IMAGE_NAME"] = ctx.ImageName
+	}
+	if len(ctx.ImageID) >= 12 {
+		vars["IMAGE_ID"] = ctx.ImageID[:12]
 	}
 
 	extraAttrs := ctx.ExtraAttributes(strings.ToTitle)
@@ -71,18 +93,46 @@ func New(ctx logger.Context) (logger.Logger, error) {
 		vars[k] = v
 	}
 
-	pr := semistruct.NewLogParser()
-	return &journald{vars: vars, parser: pr, readers: readerList{readers: make(map[*logger.LogWatcher]*logger.LogWatcher)}}, nil
+	epoch, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+
+	parser, err := newLineParser(ctx.Config["format"], ctx.Config["sentinel"], ctx.Config["grammar"])
+	if err != nil {
+		return nil, err
+	}
+
+	return &journald{
+		vars:        vars,
+		parser:      parser,
+		containerID: ctx.ContainerID,
+		epoch:       epoch,
+		readers:     readerList{readers: make(map[*logger.LogWatcher]*logger.LogWatcher)},
+	}, nil
 }
 
-// We don't actually accept any options, but we have to supply a callback for
-// the factory to pass the (probably empty) configuration map to.
 func validateLogOpt(cfg map[string]string) error {
-	for key := range cfg {
+	for key, value := range cfg {
 		switch key {
 		case "labels":
 		case "env":
 		case "tag":
+		case "syslog-identifier":
+		case "format":
+			switch value {
+			case "", "semistruct", "json", "logfmt", "auto":
+			default:
+				return fmt.Errorf("unknown format %q for journald-semistruct log driver", value)
+			}
+		case "sentinel":
+			if len(value) > maxSentinelLen {
+				return fmt.Errorf("sentinel %q exceeds the %d byte limit for journald-semistruct log driver", value, maxSentinelLen)
+			}
+		case "grammar":
+			if _, ok := grammars[value]; value != "" && !ok {
+				return fmt.Errorf("unknown grammar %q for journald-semistruct log driver", value)
+			}
 		default:
 			return fmt.Errorf("unknown log opt '%s' for journald log driver", key)
 		}
@@ -91,32 +141,43 @@ func validateLogOpt(cfg map[string]string) error {
 }
 
 func (s *journald) Log(msg *logger.Message) error {
-	journaldVars := s.vars
+	// Copy s.vars rather than aliasing it: journaldVars below is
+	// mutated per-line with the parsed TAGS/attrs, and those must not
+	// leak back into the shared per-container defaults.
+	journaldVars := copyVars(s.vars)
+	journaldVars[epochField] = s.epoch
+	journaldVars[ordinalField] = strconv.FormatUint(atomic.AddUint64(&s.ordinal, 1), 10)
+	// The journal's own reception time can lag the container's actual
+	// emission time; carry the latter through explicitly so it isn't
+	// masked.
+	journaldVars["SYSLOG_TIMESTAMP"] = msg.Timestamp.Format(time.RFC3339Nano)
 
 	line := string(msg.Line)
 
-	// If we have a successful parse, let's set the journal priority
-	// using the integer priority value from the semistructured log
-	// line, if not let's just set it to Err or Info as-per the stock
-	// journald logging driver.
+	// If the configured parser finds structure in the line, use it to
+	// set the journal priority and extra fields; otherwise fall back to
+	// Err or Info as-per the stock journald logging driver.
 	var priority journal.Priority
 
-	if parsedLog, err := parseSemistruct(line, s.parser); err == nil && parsedLog != nil {
-		res, ok := parsedLog.(semistruct.Log)
-
-		if ok {
-			priority = journal.Priority(res.Priority)
-			journaldVars["TAGS"] = strings.Join(res.Tags, ":")
-			for k, v := range res.Attrs {
-				journaldVars[k] = v
-			}
-		} else {
-			priority = defaultPriority(msg.Source)
+	if parsed, err := s.parser.Parse(line); err == nil && parsed != nil {
+		priority = parsed.Priority
+		if len(parsed.Tags) > 0 {
+			journaldVars["TAGS"] = strings.Join(parsed.Tags, ":")
+		}
+		for k, v := range parsed.Attrs {
+			journaldVars[k] = v
 		}
 	} else {
 		priority = defaultPriority(msg.Source)
 	}
 
+	// journald truncates fields beyond its own size limit, so an
+	// oversized line has to be split into partial-message chunks
+	// instead of being sent as one journal.Send call.
+	if len(line) > maxLineBytes {
+		return s.sendPartials(line, priority, journaldVars)
+	}
+
 	// NOTE: we always send the whole line to journald even though
 	// it's semi-structured, the fact that we have some structure to
 	// parse just gives us more fields to filter by with journalctl.
@@ -124,28 +185,23 @@ func (s *journald) Log(msg *logger.Message) error {
 }
 
 func defaultPriority(source string) journal.Priority {
-	if msg.Source == "stderr" {
+	if source == "stderr" {
 		return journal.PriErr
 	} else {
 		return journal.PriInfo
 	}
 }
 
-func parseSemistruct(s string, parser *cp.Grammar) (cp.Match, error) {
-	// Peak at the first few characters, if they start with the
-	// sentinel then attempt a parse
-	if len(s) > 2 && s[:2] == "!<" {
-		if parsedLog, err := parser.ParseString(s); err != nil && parsedLog == nil {
-			logrus.Errorf("failed to parse semistructured log line: %v", err)
-			return nil, err
-		} else {
-			return parsedLog, nil
-		}
-	} else {
-		return nil, errors.New("sentinel not seen")
-	}
-}
-
 func (s *journald) Name() string {
 	return name
 }
+
+// Close shuts down every outstanding LogWatcher started by ReadLogs.
+func (s *journald) Close() error {
+	s.readers.mu.Lock()
+	for _, r := range s.readers.readers {
+		r.Close()
+	}
+	s.readers.mu.Unlock()
+	return nil
+}
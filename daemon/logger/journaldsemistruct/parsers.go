@@ -0,0 +1,322 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/coreos/go-systemd/journal"
+)
+
+// maxFieldNameLen caps how long a sanitized field name can be; longer names
+// are truncated to this length. journald itself allows longer names, but
+// this keeps attacker- or bug-supplied field names from growing unbounded.
+const maxFieldNameLen = 64
+
+// ParsedLine is the normalized result of finding structure in a single log
+// line: a journal priority, free-form tags, and extra journal fields.
+type ParsedLine struct {
+	Priority journal.Priority
+	Tags     []string
+	Attrs    map[string]string
+}
+
+// LineParser extracts structure from a single log line, reporting
+// errNoMatch when the line isn't in the parser's format.
+type LineParser interface {
+	Parse(line string) (*ParsedLine, error)
+}
+
+// errNoMatch means the line didn't look like this parser's format at all,
+// as opposed to looking like it but failing to parse.
+var errNoMatch = errors.New("line did not match parser's format")
+
+// newLineParser builds the LineParser for the driver's `format`, `sentinel`
+// and `grammar` log-opts. Empty values default to the original
+// semistruct-only behavior.
+func newLineParser(format, sentinel, grammarName string) (LineParser, error) {
+	sem, err := newSemistructLineParser(sentinel, grammarName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "", "semistruct":
+		return sem, nil
+	case "json":
+		return jsonLineParser{}, nil
+	case "logfmt":
+		return logfmtLineParser{}, nil
+	case "auto":
+		return &autoLineParser{semistruct: sem}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q for journald-semistruct log driver", format)
+	}
+}
+
+// semistructLineParser is the sentinel-gated grammar parser: it only
+// attempts grammar.Parse once the line starts with sentinel, so a driver
+// instance can be pointed at any prefix-tagged log dialect registered in
+// grammars.
+type semistructLineParser struct {
+	sentinel string
+	name     string
+	grammar  grammarParser
+}
+
+func newSemistructLineParser(sentinel, grammarName string) (*semistructLineParser, error) {
+	if sentinel == "" {
+		sentinel = defaultSentinel
+	}
+	if len(sentinel) > maxSentinelLen {
+		return nil, fmt.Errorf("sentinel %q exceeds the %d byte limit for journald-semistruct log driver", sentinel, maxSentinelLen)
+	}
+
+	if grammarName == "" {
+		grammarName = defaultGrammarName
+	}
+	g, ok := grammars[grammarName]
+	if !ok {
+		return nil, fmt.Errorf("unknown grammar %q for journald-semistruct log driver", grammarName)
+	}
+
+	return &semistructLineParser{sentinel: sentinel, name: grammarName, grammar: g}, nil
+}
+
+func (p *semistructLineParser) Parse(line string) (*ParsedLine, error) {
+	if len(line) < len(p.sentinel) || line[:len(p.sentinel)] != p.sentinel {
+		return nil, errNoMatch
+	}
+
+	// Strip the configured sentinel before handing the line to the
+	// grammar. The built-in semistruct grammar's own literal tokens
+	// (e.g. "!<") are fixed by the vendored parser regardless of what
+	// sentinel an operator configured for the sniff above, so put that
+	// fixed literal back on for it; custom grammars just get the body.
+	body := line[len(p.sentinel):]
+	if p.name == defaultGrammarName {
+		body = defaultSentinel + body
+	}
+
+	priority, tags, attrs, err := p.grammar.Parse(body)
+	if err != nil {
+		warnOnce.Warnf("journald-semistruct: failed to parse line with %q grammar: %v", p.name, err)
+		return nil, err
+	}
+
+	return &ParsedLine{Priority: priority, Tags: tags, Attrs: attrs}, nil
+}
+
+// jsonLineParser treats the line as a flat JSON object.
+type jsonLineParser struct{}
+
+func (jsonLineParser) Parse(line string) (*ParsedLine, error) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.HasPrefix(trimmed, "{") {
+		return nil, errNoMatch
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(trimmed), &fields); err != nil {
+		return nil, errNoMatch
+	}
+
+	return normalizeFields(fields), nil
+}
+
+// logfmtLineParser parses `key=value key2="quoted value"` lines.
+type logfmtLineParser struct{}
+
+func (logfmtLineParser) Parse(line string) (*ParsedLine, error) {
+	trimmed := strings.TrimSpace(line)
+	if !strings.Contains(trimmed, "=") {
+		return nil, errNoMatch
+	}
+
+	fields := map[string]interface{}{}
+	for _, tok := range splitLogfmtTokens(trimmed) {
+		k, v, ok := splitLogfmtPair(tok)
+		if ok {
+			fields[k] = v
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errNoMatch
+	}
+
+	return normalizeFields(fields), nil
+}
+
+// autoLineParser sniffs the first non-whitespace byte of the line and
+// dispatches to the matching parser.
+type autoLineParser struct {
+	semistruct *semistructLineParser
+	json       jsonLineParser
+	logfmt     logfmtLineParser
+}
+
+func (p *autoLineParser) Parse(line string) (*ParsedLine, error) {
+	trimmed := strings.TrimSpace(line)
+	switch {
+	case strings.HasPrefix(trimmed, "{"):
+		return p.json.Parse(line)
+	case strings.HasPrefix(trimmed, p.semistruct.sentinel):
+		return p.semistruct.Parse(line)
+	case strings.Contains(trimmed, "="):
+		return p.logfmt.Parse(line)
+	default:
+		return nil, errNoMatch
+	}
+}
+
+// normalizeFields maps a flat set of parsed fields onto a ParsedLine:
+// level/severity selects the priority, tags becomes TAGS, and everything
+// else is uppercased into a journal attribute.
+func normalizeFields(fields map[string]interface{}) *ParsedLine {
+	parsed := &ParsedLine{Priority: journal.PriInfo, Attrs: map[string]string{}}
+
+	for k, v := range fields {
+		switch strings.ToLower(k) {
+		case "level", "severity":
+			parsed.Priority = priorityFromLevel(fmt.Sprintf("%v", v))
+			continue
+		case "tags":
+			parsed.Tags = toTags(v)
+			continue
+		}
+
+		name, ok := sanitizeFieldName(k)
+		if !ok {
+			warnOnce.Warnf("journald-semistruct: dropping log field %q: not a valid journal field name", k)
+			continue
+		}
+		parsed.Attrs[name] = fmt.Sprintf("%v", v)
+	}
+
+	return parsed
+}
+
+func toTags(v interface{}) []string {
+	switch t := v.(type) {
+	case []interface{}:
+		tags := make([]string, 0, len(t))
+		for _, e := range t {
+			tags = append(tags, fmt.Sprintf("%v", e))
+		}
+		return tags
+	case string:
+		return strings.Split(t, ":")
+	default:
+		return nil
+	}
+}
+
+func priorityFromLevel(level string) journal.Priority {
+	switch strings.ToLower(level) {
+	case "debug":
+		return journal.PriDebug
+	case "info", "informational":
+		return journal.PriInfo
+	case "notice":
+		return journal.PriNotice
+	case "warn", "warning":
+		return journal.PriWarning
+	case "error", "err":
+		return journal.PriErr
+	case "crit", "critical":
+		return journal.PriCrit
+	case "alert":
+		return journal.PriAlert
+	case "emerg", "emergency", "panic":
+		return journal.PriEmerg
+	default:
+		return journal.PriInfo
+	}
+}
+
+// sanitizeFieldName upper-cases and strips a parsed key down to journald's
+// field grammar ([A-Z0-9_], not starting with a digit or underscore,
+// length-limited). It reports ok=false when nothing usable is left.
+func sanitizeFieldName(k string) (string, bool) {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(k) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		}
+	}
+
+	name := b.String()
+	if name == "" || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+		return "", false
+	}
+	if len(name) > maxFieldNameLen {
+		name = name[:maxFieldNameLen]
+	}
+	return name, true
+}
+
+// splitLogfmtTokens splits a logfmt line on unquoted spaces.
+func splitLogfmtTokens(s string) []string {
+	var tokens []string
+	var buf strings.Builder
+	inQuotes := false
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			inQuotes = !inQuotes
+			buf.WriteByte(c)
+		case c == ' ' && !inQuotes:
+			if buf.Len() > 0 {
+				tokens = append(tokens, buf.String())
+				buf.Reset()
+			}
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	if buf.Len() > 0 {
+		tokens = append(tokens, buf.String())
+	}
+	return tokens
+}
+
+func splitLogfmtPair(tok string) (key, value string, ok bool) {
+	idx := strings.Index(tok, "=")
+	if idx < 0 {
+		return "", "", false
+	}
+	return tok[:idx], strings.Trim(tok[idx+1:], `"`), true
+}
+
+// warnOnce rate-limits the dropped-field and grammar parse-failure warnings
+// so a log stream full of one bad field or line doesn't flood the daemon's
+// own log.
+var warnOnce = newRateLimitedLogger(time.Minute)
+
+type rateLimitedLogger struct {
+	mu    sync.Mutex
+	every time.Duration
+	last  time.Time
+}
+
+func newRateLimitedLogger(every time.Duration) *rateLimitedLogger {
+	return &rateLimitedLogger{every: every}
+}
+
+func (r *rateLimitedLogger) Warnf(format string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := time.Now(); now.Sub(r.last) >= r.every {
+		r.last = now
+		logrus.Warnf(format, args...)
+	}
+}
@@ -0,0 +1,203 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/coreos/go-systemd/journal"
+)
+
+func TestSanitizeFieldName(t *testing.T) {
+	cases := []struct {
+		name   string
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{"simple", "host", "HOST", true},
+		{"already upper", "REQUEST_ID", "REQUEST_ID", true},
+		{"strips invalid bytes", "req-id.v2", "REQIDV2", true},
+		{"empty after stripping", "---", "", false},
+		{"empty input", "", "", false},
+		{"leading underscore", "_internal", "", false},
+		{"leading digit", "1st", "", false},
+		{"over length is truncated not dropped", strings.Repeat("a", maxFieldNameLen+10), strings.Repeat("A", maxFieldNameLen), true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, ok := sanitizeFieldName(c.in)
+			if ok != c.wantOK {
+				t.Fatalf("sanitizeFieldName(%q) ok = %v, want %v", c.in, ok, c.wantOK)
+			}
+			if ok && got != c.want {
+				t.Fatalf("sanitizeFieldName(%q) = %q, want %q", c.in, got, c.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeFieldsPriorityAndTags(t *testing.T) {
+	parsed := normalizeFields(map[string]interface{}{
+		"level":   "warning",
+		"tags":    []interface{}{"a", "b"},
+		"request": "abc123",
+	})
+
+	if parsed.Priority != journal.PriWarning {
+		t.Fatalf("Priority = %v, want %v", parsed.Priority, journal.PriWarning)
+	}
+	if !reflect.DeepEqual(parsed.Tags, []string{"a", "b"}) {
+		t.Fatalf("Tags = %v, want [a b]", parsed.Tags)
+	}
+	if parsed.Attrs["REQUEST"] != "abc123" {
+		t.Fatalf("Attrs[REQUEST] = %q, want %q", parsed.Attrs["REQUEST"], "abc123")
+	}
+}
+
+func TestNormalizeFieldsDropsUnsanitizableKeys(t *testing.T) {
+	parsed := normalizeFields(map[string]interface{}{
+		"---": "dropped",
+		"ok":  "kept",
+	})
+
+	if _, present := parsed.Attrs["---"]; present {
+		t.Fatalf("expected unsanitizable key to be dropped, got %v", parsed.Attrs)
+	}
+	if parsed.Attrs["OK"] != "kept" {
+		t.Fatalf("Attrs[OK] = %q, want %q", parsed.Attrs["OK"], "kept")
+	}
+}
+
+func TestToTags(t *testing.T) {
+	if got := toTags("a:b:c"); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Fatalf("toTags(string) = %v", got)
+	}
+	if got := toTags([]interface{}{"x", "y"}); !reflect.DeepEqual(got, []string{"x", "y"}) {
+		t.Fatalf("toTags([]interface{}) = %v", got)
+	}
+	if got := toTags(42); got != nil {
+		t.Fatalf("toTags(unsupported) = %v, want nil", got)
+	}
+}
+
+func TestPriorityFromLevel(t *testing.T) {
+	cases := map[string]journal.Priority{
+		"debug":   journal.PriDebug,
+		"INFO":    journal.PriInfo,
+		"warn":    journal.PriWarning,
+		"warning": journal.PriWarning,
+		"err":     journal.PriErr,
+		"error":   journal.PriErr,
+		"emerg":   journal.PriEmerg,
+		"bogus":   journal.PriInfo,
+	}
+	for level, want := range cases {
+		if got := priorityFromLevel(level); got != want {
+			t.Errorf("priorityFromLevel(%q) = %v, want %v", level, got, want)
+		}
+	}
+}
+
+func TestSplitLogfmtTokens(t *testing.T) {
+	got := splitLogfmtTokens(`level=info msg="hello world" req_id=abc`)
+	want := []string{"level=info", `msg="hello world"`, "req_id=abc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("splitLogfmtTokens = %v, want %v", got, want)
+	}
+}
+
+func TestSplitLogfmtPair(t *testing.T) {
+	k, v, ok := splitLogfmtPair(`msg="hello world"`)
+	if !ok || k != "msg" || v != "hello world" {
+		t.Fatalf("splitLogfmtPair(quoted) = (%q, %q, %v)", k, v, ok)
+	}
+
+	if _, _, ok := splitLogfmtPair("no-equals-sign"); ok {
+		t.Fatalf("splitLogfmtPair(no =) should not match")
+	}
+}
+
+func TestLogfmtLineParser(t *testing.T) {
+	p := logfmtLineParser{}
+
+	parsed, err := p.Parse(`level=error service=api`)
+	if err != nil {
+		t.Fatalf("Parse returned err: %v", err)
+	}
+	if parsed.Priority != journal.PriErr {
+		t.Fatalf("Priority = %v, want PriErr", parsed.Priority)
+	}
+	if parsed.Attrs["SERVICE"] != "api" {
+		t.Fatalf("Attrs[SERVICE] = %q, want api", parsed.Attrs["SERVICE"])
+	}
+
+	if _, err := p.Parse("no key value pairs here"); err != errNoMatch {
+		t.Fatalf("Parse(non-logfmt) err = %v, want errNoMatch", err)
+	}
+}
+
+func TestJSONLineParser(t *testing.T) {
+	p := jsonLineParser{}
+
+	parsed, err := p.Parse(`{"level":"notice","tags":["a","b"],"path":"/health"}`)
+	if err != nil {
+		t.Fatalf("Parse returned err: %v", err)
+	}
+	if parsed.Priority != journal.PriNotice {
+		t.Fatalf("Priority = %v, want PriNotice", parsed.Priority)
+	}
+	if !reflect.DeepEqual(parsed.Tags, []string{"a", "b"}) {
+		t.Fatalf("Tags = %v, want [a b]", parsed.Tags)
+	}
+	if parsed.Attrs["PATH"] != "/health" {
+		t.Fatalf("Attrs[PATH] = %q, want /health", parsed.Attrs["PATH"])
+	}
+
+	if _, err := p.Parse("not json"); err != errNoMatch {
+		t.Fatalf("Parse(non-json) err = %v, want errNoMatch", err)
+	}
+}
+
+func TestLTSVGrammar(t *testing.T) {
+	g := ltsvGrammar{}
+
+	priority, tags, attrs, err := g.Parse("level:warning\ttags:a:b\thost:web1")
+	if err != nil {
+		t.Fatalf("Parse returned err: %v", err)
+	}
+	if priority != journal.PriWarning {
+		t.Fatalf("priority = %v, want PriWarning", priority)
+	}
+	if !reflect.DeepEqual(tags, []string{"a", "b"}) {
+		t.Fatalf("tags = %v, want [a b]", tags)
+	}
+	if attrs["HOST"] != "web1" {
+		t.Fatalf("attrs[HOST] = %q, want web1", attrs["HOST"])
+	}
+
+	if _, _, _, err := g.Parse("no labels in this line"); err != errNoMatch {
+		t.Fatalf("Parse(no labels) err = %v, want errNoMatch", err)
+	}
+}
+
+func TestGelfShortGrammar(t *testing.T) {
+	g := gelfShortGrammar{}
+
+	priority, tags, attrs, err := g.Parse("error|db,slow|query=select_1 rows=3")
+	if err != nil {
+		t.Fatalf("Parse returned err: %v", err)
+	}
+	if priority != journal.PriErr {
+		t.Fatalf("priority = %v, want PriErr", priority)
+	}
+	if !reflect.DeepEqual(tags, []string{"db", "slow"}) {
+		t.Fatalf("tags = %v, want [db slow]", tags)
+	}
+	if attrs["QUERY"] != "select_1" || attrs["ROWS"] != "3" {
+		t.Fatalf("attrs = %v", attrs)
+	}
+}
@@ -0,0 +1,89 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/coreos/go-systemd/journal"
+)
+
+// maxLineBytes keeps an individual journal.Send field comfortably under
+// journald's own per-field size limit, which otherwise silently truncates
+// long log lines.
+const maxLineBytes = 8 * 1024
+
+const (
+	partialMessageField = "CONTAINER_PARTIAL_MESSAGE"
+	partialIDField      = "CONTAINER_PARTIAL_ID"
+	partialOrdinalField = "CONTAINER_PARTIAL_ORDINAL"
+	partialLastField    = "CONTAINER_PARTIAL_LAST"
+
+	// epochField and ordinalField give every message (and every partial
+	// chunk of it, which all share one ordinal) a well-defined total
+	// order across readers and daemon restarts.
+	epochField   = "CONTAINER_LOG_EPOCH"
+	ordinalField = "CONTAINER_LOG_ORDINAL"
+)
+
+// sendPartials breaks an oversized line into maxLineBytes-sized chunks and
+// emits one journal.Send per chunk, all sharing a freshly generated
+// CONTAINER_PARTIAL_ID so ReadLogs can reassemble them in order. The parsed
+// semistruct fields in journaldVars (TAGS and friends) are attached to
+// every chunk so filter queries still match on any of them.
+func (s *journald) sendPartials(line string, priority journal.Priority, journaldVars map[string]string) error {
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	chunks := chunkLine(line, maxLineBytes)
+
+	for i, chunk := range chunks {
+		vars := copyVars(journaldVars)
+		vars[partialMessageField] = "true"
+		vars[partialIDField] = id
+		vars[partialOrdinalField] = strconv.Itoa(i + 1)
+		if i == len(chunks)-1 {
+			vars[partialLastField] = "true"
+		}
+
+		if err := journal.Send(chunk, priority, vars); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// chunkLine splits line into pieces of at most size bytes.
+func chunkLine(line string, size int) []string {
+	var chunks []string
+	for len(line) > size {
+		chunks = append(chunks, line[:size])
+		line = line[size:]
+	}
+	return append(chunks, line)
+}
+
+// copyVars returns a shallow copy of vars so callers can mutate it without
+// affecting the caller's map.
+func copyVars(vars map[string]string) map[string]string {
+	cp := make(map[string]string, len(vars))
+	for k, v := range vars {
+		cp[k] = v
+	}
+	return cp
+}
+
+// randomHex returns n random bytes hex-encoded, used to mint the
+// per-message CONTAINER_PARTIAL_ID and the driver's per-instance log epoch.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
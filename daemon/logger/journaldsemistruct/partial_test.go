@@ -0,0 +1,197 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"testing"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+func TestChunkLine(t *testing.T) {
+	cases := []struct {
+		name string
+		line string
+		size int
+		want []string
+	}{
+		{"empty", "", 4, []string{""}},
+		{"exact fit", "abcd", 4, []string{"abcd"}},
+		{"even split", "abcdefgh", 4, []string{"abcd", "efgh"}},
+		{"uneven split", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"shorter than size", "ab", 4, []string{"ab"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := chunkLine(c.line, c.size)
+			if len(got) != len(c.want) {
+				t.Fatalf("chunkLine(%q, %d) = %v, want %v", c.line, c.size, got, c.want)
+			}
+			for i := range got {
+				if got[i] != c.want[i] {
+					t.Fatalf("chunkLine(%q, %d)[%d] = %q, want %q", c.line, c.size, i, got[i], c.want[i])
+				}
+			}
+
+			var rejoined string
+			for _, chunk := range got {
+				rejoined += chunk
+			}
+			if rejoined != c.line {
+				t.Fatalf("chunks do not rejoin to the original line: got %q, want %q", rejoined, c.line)
+			}
+		})
+	}
+}
+
+// TestPartialAssemblerReassemblesInOrder mirrors what sendPartials writes
+// and ReadLogs reads back: chunks for one message share a PARTIAL_ID, are
+// numbered by PARTIAL_ORDINAL, and the last one carries PARTIAL_LAST.
+func TestPartialAssemblerReassemblesInOrder(t *testing.T) {
+	p := newPartialAssembler()
+
+	entries := []*sdjournal.JournalEntry{
+		{Fields: map[string]string{
+			"MESSAGE":           "hello ",
+			partialMessageField: "true",
+			partialIDField:      "req-1",
+			partialOrdinalField: "1",
+		}},
+		{Fields: map[string]string{
+			"MESSAGE":           "world",
+			partialMessageField: "true",
+			partialIDField:      "req-1",
+			partialOrdinalField: "2",
+			partialLastField:    "true",
+		}},
+	}
+
+	msg, ready, err := p.process(entries[0])
+	if err != nil {
+		t.Fatalf("process(chunk 1) returned err: %v", err)
+	}
+	if ready {
+		t.Fatalf("process(chunk 1) reported ready before the last chunk arrived")
+	}
+	if msg != nil {
+		t.Fatalf("process(chunk 1) returned a message before reassembly finished")
+	}
+
+	msg, ready, err = p.process(entries[1])
+	if err != nil {
+		t.Fatalf("process(chunk 2) returned err: %v", err)
+	}
+	if !ready || msg == nil {
+		t.Fatalf("process(chunk 2) did not reassemble: ready=%v msg=%v", ready, msg)
+	}
+	if got := string(msg.Line); got != "hello world\n" {
+		t.Fatalf("reassembled line = %q, want %q", got, "hello world\n")
+	}
+}
+
+// TestPartialAssemblerSortsScrambledChunks verifies the assembler corrects
+// for chunks of the same message arriving out of ordinal order, as long as
+// every chunk from 1 through PARTIAL_LAST has arrived by the time the last
+// one is seen.
+func TestPartialAssemblerSortsScrambledChunks(t *testing.T) {
+	p := newPartialAssembler()
+
+	entry := func(ordinal, line string, last bool) *sdjournal.JournalEntry {
+		fields := map[string]string{
+			"MESSAGE":           line,
+			partialMessageField: "true",
+			partialIDField:      "req-2",
+			partialOrdinalField: ordinal,
+		}
+		if last {
+			fields[partialLastField] = "true"
+		}
+		return &sdjournal.JournalEntry{Fields: fields}
+	}
+
+	if _, ready, err := p.process(entry("2", "CD", false)); err != nil || ready {
+		t.Fatalf("process(ordinal 2) = ready=%v err=%v", ready, err)
+	}
+	if _, ready, err := p.process(entry("1", "AB", false)); err != nil || ready {
+		t.Fatalf("process(ordinal 1) = ready=%v err=%v", ready, err)
+	}
+
+	msg, ready, err := p.process(entry("3", "EF", true))
+	if err != nil {
+		t.Fatalf("process(ordinal 3) returned err: %v", err)
+	}
+	if !ready || msg == nil {
+		t.Fatalf("process(ordinal 3) did not reassemble: ready=%v msg=%v", ready, msg)
+	}
+	if got := string(msg.Line); got != "ABCDEF\n" {
+		t.Fatalf("reassembled line = %q, want %q", got, "ABCDEF\n")
+	}
+}
+
+// TestPartialAssemblerWaitsForMissingChunk covers the case the scrambled
+// test above doesn't: the PARTIAL_LAST chunk arriving while an earlier
+// ordinal is still missing. The assembler must keep waiting instead of
+// joining whatever it has and returning a truncated message.
+func TestPartialAssemblerWaitsForMissingChunk(t *testing.T) {
+	p := newPartialAssembler()
+
+	entry := func(ordinal, line string, last bool) *sdjournal.JournalEntry {
+		fields := map[string]string{
+			"MESSAGE":           line,
+			partialMessageField: "true",
+			partialIDField:      "req-3",
+			partialOrdinalField: ordinal,
+		}
+		if last {
+			fields[partialLastField] = "true"
+		}
+		return &sdjournal.JournalEntry{Fields: fields}
+	}
+
+	if _, ready, err := p.process(entry("1", "AB", false)); err != nil || ready {
+		t.Fatalf("process(ordinal 1) = ready=%v err=%v", ready, err)
+	}
+	// Ordinal 2 ("CD") hasn't arrived yet, but the PARTIAL_LAST chunk has.
+	if msg, ready, err := p.process(entry("3", "EF", true)); err != nil || ready || msg != nil {
+		t.Fatalf("process(ordinal 3, last) = ready=%v msg=%v err=%v, want not ready", ready, msg, err)
+	}
+
+	msg, ready, err := p.process(entry("2", "CD", false))
+	if err != nil {
+		t.Fatalf("process(ordinal 2) returned err: %v", err)
+	}
+	if !ready || msg == nil {
+		t.Fatalf("process(ordinal 2) did not complete the series: ready=%v msg=%v", ready, msg)
+	}
+	if got := string(msg.Line); got != "ABCDEF\n" {
+		t.Fatalf("reassembled line = %q, want %q", got, "ABCDEF\n")
+	}
+}
+
+func TestEntryToMessageEmptyLine(t *testing.T) {
+	msg, err := entryToMessage(&sdjournal.JournalEntry{Fields: map[string]string{}}, "")
+	if err != nil {
+		t.Fatalf("entryToMessage returned err: %v", err)
+	}
+	if msg == nil {
+		t.Fatalf("entryToMessage(empty line) = nil, want a message for the empty log line")
+	}
+	if got := string(msg.Line); got != "\n" {
+		t.Fatalf("entryToMessage(empty line).Line = %q, want %q", got, "\n")
+	}
+}
+
+// TestPartialAssemblerProcessNoMessageField covers a non-partial entry
+// missing the MESSAGE field entirely, as distinct from one whose MESSAGE
+// is the empty string (a real, empty log line).
+func TestPartialAssemblerProcessNoMessageField(t *testing.T) {
+	p := newPartialAssembler()
+	msg, ready, err := p.process(&sdjournal.JournalEntry{Fields: map[string]string{}})
+	if err != nil {
+		t.Fatalf("process returned err: %v", err)
+	}
+	if ready || msg != nil {
+		t.Fatalf("process(no MESSAGE field) = ready=%v msg=%v, want not ready", ready, msg)
+	}
+}
@@ -0,0 +1,323 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/coreos/go-systemd/sdjournal"
+	"github.com/docker/docker/daemon/logger"
+)
+
+// wellKnownFields are the journal fields the driver or systemd itself
+// manages; everything else on an entry is a candidate semistruct
+// attribute that should be restored onto the message.
+var wellKnownFields = map[string]bool{
+	"MESSAGE":           true,
+	"TAGS":              true,
+	"PRIORITY":          true,
+	"SYSLOG_IDENTIFIER": true,
+	"SYSLOG_FACILITY":   true,
+	"CONTAINER_ID":      true,
+	"CONTAINER_ID_FULL": true,
+	"CONTAINER_NAME":    true,
+	"CONTAINER_TAG":     true,
+	"IMAGE_NAME":        true,
+	"IMAGE_ID":          true,
+	"SYSLOG_TIMESTAMP":  true,
+	partialMessageField: true,
+	partialIDField:      true,
+	partialOrdinalField: true,
+	partialLastField:    true,
+	epochField:          true,
+	ordinalField:        true,
+}
+
+// reorderWindow bounds how many ready messages we buffer before sorting
+// them by (generation, ordinal) and flushing; the journal's own delivery
+// order can reorder entries slightly (e.g. around a daemon restart), and
+// this corrects for that without holding a follow-mode read open
+// indefinitely.
+const reorderWindow = 64
+
+// journalWaitInterval bounds a single call to j.Wait() in the follow loop.
+// Blocking indefinitely would leave a closed watcher's goroutine (and its
+// open journal handle) stuck until the next unrelated write anywhere on
+// the host's journal woke it up, so the wait is chopped into intervals the
+// loop can re-check watcher.WatchClose() between.
+const journalWaitInterval = 250 * time.Millisecond
+
+// ReadLogs satisfies logger.LogReader by streaming this container's entries
+// back out of the systemd journal, filtered by CONTAINER_ID_FULL.
+func (s *journald) ReadLogs(config logger.ReadConfig) *logger.LogWatcher {
+	watcher := logger.NewLogWatcher()
+	go s.readLogs(watcher, config)
+	return watcher
+}
+
+func (s *journald) readLogs(watcher *logger.LogWatcher, config logger.ReadConfig) {
+	defer close(watcher.Msg)
+
+	s.readers.mu.Lock()
+	s.readers.readers[watcher] = watcher
+	s.readers.mu.Unlock()
+
+	defer func() {
+		s.readers.mu.Lock()
+		delete(s.readers.readers, watcher)
+		s.readers.mu.Unlock()
+	}()
+
+	j, err := sdjournal.NewJournal()
+	if err != nil {
+		watcher.Err <- err
+		return
+	}
+	defer j.Close()
+
+	partials := newPartialAssembler()
+	var buffer []sequencedMessage
+	// epochGenerations assigns each epoch the order it was first seen in
+	// this read, so the reorder buffer can sort on real arrival order
+	// across a restart boundary rather than on the epoch's random value.
+	epochGenerations := map[string]int{}
+
+	if err := j.AddMatch("CONTAINER_ID_FULL=" + s.containerID); err != nil {
+		watcher.Err <- err
+		return
+	}
+
+	if !config.Since.IsZero() {
+		if err := j.SeekRealtimeUsec(uint64(config.Since.UnixNano() / int64(time.Microsecond))); err != nil {
+			watcher.Err <- err
+			return
+		}
+	} else if config.Tail >= 0 {
+		if err := j.SeekTail(); err != nil {
+			watcher.Err <- err
+			return
+		}
+		// SeekTail() positions just past the last entry, so step back
+		// over the entries we want to replay plus the one Next() needs
+		// to land on.
+		if _, err := j.PreviousSkip(uint64(config.Tail) + 1); err != nil {
+			watcher.Err <- err
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-watcher.WatchClose():
+			return
+		default:
+		}
+
+		n, err := j.Next()
+		if err != nil {
+			watcher.Err <- err
+			return
+		}
+
+		if n == 0 {
+			if !flushBuffer(watcher, &buffer) {
+				return
+			}
+			if !config.Follow {
+				return
+			}
+			// Check WatchClose() again right before blocking: a close
+			// that landed while we were flushing shouldn't cost the
+			// caller a full journalWaitInterval.
+			select {
+			case <-watcher.WatchClose():
+				return
+			default:
+			}
+			if status := j.Wait(journalWaitInterval); status < 0 {
+				watcher.Err <- fmt.Errorf("journald-semistruct: journal wait failed: status %d", status)
+				return
+			}
+			continue
+		}
+
+		entry, err := j.GetEntry()
+		if err != nil {
+			watcher.Err <- err
+			return
+		}
+
+		msg, ready, err := partials.process(entry)
+		if err != nil || !ready || msg == nil {
+			continue
+		}
+
+		epoch := entry.Fields[epochField]
+		generation, seen := epochGenerations[epoch]
+		if !seen {
+			generation = len(epochGenerations)
+			epochGenerations[epoch] = generation
+		}
+
+		buffer = append(buffer, sequencedMessage{
+			generation: generation,
+			ordinal:    parseOrdinal(entry.Fields[ordinalField]),
+			msg:        msg,
+		})
+
+		if len(buffer) >= reorderWindow {
+			if !flushBuffer(watcher, &buffer) {
+				return
+			}
+		}
+	}
+}
+
+// sequencedMessage pairs a reassembled message with the order it actually
+// arrived in (generation) and the per-epoch ordinal Log attached to it, so
+// the reorder buffer can restore total order.
+type sequencedMessage struct {
+	generation int
+	ordinal    uint64
+	msg        *logger.Message
+}
+
+func parseOrdinal(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+// flushBuffer sorts the buffered messages by (generation, ordinal) and
+// emits them in that order, clearing the buffer. generation reflects the
+// order this read actually saw each epoch first, so it recovers real
+// arrival order across a restart boundary; the random epoch value itself
+// is not ordered and sorting on it directly would be a coin flip. It
+// returns false if the watcher was closed mid-flush, in which case the
+// caller should stop.
+func flushBuffer(watcher *logger.LogWatcher, buffer *[]sequencedMessage) bool {
+	sort.SliceStable(*buffer, func(i, j int) bool {
+		a, b := (*buffer)[i], (*buffer)[j]
+		if a.generation != b.generation {
+			return a.generation < b.generation
+		}
+		return a.ordinal < b.ordinal
+	})
+
+	for _, sm := range *buffer {
+		select {
+		case watcher.Msg <- sm.msg:
+		case <-watcher.WatchClose():
+			*buffer = (*buffer)[:0]
+			return false
+		}
+	}
+
+	*buffer = (*buffer)[:0]
+	return true
+}
+
+// partialAssembler reassembles CONTAINER_PARTIAL_MESSAGE chunks, buffered
+// by CONTAINER_PARTIAL_ID, into a single logger.Message once every chunk
+// from ordinal 1 through the chunk carrying CONTAINER_PARTIAL_LAST has
+// actually arrived.
+type partialAssembler struct {
+	pending map[string]*partialSeries
+}
+
+// partialSeries buffers one in-progress partial message. Chunks are kept
+// by ordinal rather than arrival order because the journal can deliver
+// them out of order (the same reason epoch/ordinal/reorderWindow exist),
+// so the chunk carrying PARTIAL_LAST is not necessarily the last one
+// process() sees.
+type partialSeries struct {
+	chunks      map[int]string
+	lastOrdinal int // 0 until the PARTIAL_LAST chunk has been seen
+}
+
+func newPartialAssembler() *partialAssembler {
+	return &partialAssembler{pending: make(map[string]*partialSeries)}
+}
+
+// process folds a single journal entry into the assembler. ready is true
+// when msg is complete and should be emitted: immediately for a
+// non-partial entry, or once a partial series has a contiguous run of
+// chunks from ordinal 1 through its PARTIAL_LAST chunk.
+func (p *partialAssembler) process(entry *sdjournal.JournalEntry) (msg *logger.Message, ready bool, err error) {
+	if entry.Fields[partialMessageField] != "true" {
+		line, hasLine := entry.Fields["MESSAGE"]
+		if !hasLine {
+			return nil, false, nil
+		}
+		msg, err = entryToMessage(entry, line)
+		return msg, true, err
+	}
+
+	id := entry.Fields[partialIDField]
+	series, ok := p.pending[id]
+	if !ok {
+		series = &partialSeries{chunks: make(map[int]string)}
+		p.pending[id] = series
+	}
+
+	ordinal, _ := strconv.Atoi(entry.Fields[partialOrdinalField])
+	series.chunks[ordinal] = entry.Fields["MESSAGE"]
+	if entry.Fields[partialLastField] == "true" {
+		series.lastOrdinal = ordinal
+	}
+
+	if series.lastOrdinal == 0 {
+		return nil, false, nil
+	}
+
+	var line string
+	for i := 1; i <= series.lastOrdinal; i++ {
+		chunk, ok := series.chunks[i]
+		if !ok {
+			// Still missing an earlier chunk: keep waiting even though
+			// PARTIAL_LAST has already been seen.
+			return nil, false, nil
+		}
+		line += chunk
+	}
+
+	delete(p.pending, id)
+	msg, err = entryToMessage(entry, line)
+	return msg, true, err
+}
+
+// entryToMessage restores a *logger.Message from a journal entry and an
+// already-resolved line (the entry's own MESSAGE field, or a partial
+// series joined back together), round-tripping the TAGS field and any
+// semistruct attributes that Log attached on write. Callers are expected
+// to have already decided the line is resolved (present, even if empty) -
+// a container writing a bare newline is a real log line, not a missing
+// one, so it's emitted rather than dropped.
+func entryToMessage(entry *sdjournal.JournalEntry, line string) (*logger.Message, error) {
+	msg := &logger.Message{
+		Line:      []byte(line + "\n"),
+		Timestamp: time.Unix(0, int64(entry.RealtimeTimestamp)*int64(time.Microsecond)),
+	}
+
+	if source, ok := entry.Fields["SYSLOG_IDENTIFIER"]; ok {
+		msg.Source = source
+	}
+
+	attrs := map[string]string{}
+	if tags, ok := entry.Fields["TAGS"]; ok && tags != "" {
+		attrs["TAGS"] = tags
+	}
+	for k, v := range entry.Fields {
+		if wellKnownFields[k] || (len(k) > 0 && k[0] == '_') {
+			continue
+		}
+		attrs[k] = v
+	}
+	if len(attrs) > 0 {
+		msg.Attrs = attrs
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,48 @@
+// +build linux
+
+package journaldsemistruct
+
+import (
+	"testing"
+
+	"github.com/docker/docker/daemon/logger"
+)
+
+// TestFlushBufferOrdersByGenerationNotEpochValue pins the fix for sorting
+// on generation (the order an epoch was actually first seen by this read)
+// rather than on the epoch string itself: two epochs are fed in the same
+// real arrival order regardless of which one happens to sort first
+// lexicographically, and the flushed order must track arrival, not the
+// epoch value.
+func TestFlushBufferOrdersByGenerationNotEpochValue(t *testing.T) {
+	watcher := logger.NewLogWatcher()
+	defer watcher.Close()
+
+	run1 := &logger.Message{Line: []byte("run1\n")}
+	run2 := &logger.Message{Line: []byte("run2\n")}
+
+	// run1 arrived first (generation 0) even though its epoch, "zzzz",
+	// sorts after run2's epoch, "aaaa", lexicographically.
+	buffer := []sequencedMessage{
+		{generation: 1, ordinal: 1, msg: run2},
+		{generation: 0, ordinal: 1, msg: run1},
+	}
+
+	done := make(chan []*logger.Message, 1)
+	go func() {
+		var got []*logger.Message
+		for i := 0; i < len(buffer); i++ {
+			got = append(got, <-watcher.Msg)
+		}
+		done <- got
+	}()
+
+	if !flushBuffer(watcher, &buffer) {
+		t.Fatalf("flushBuffer reported the watcher as closed")
+	}
+
+	got := <-done
+	if len(got) != 2 || got[0] != run1 || got[1] != run2 {
+		t.Fatalf("flushBuffer order = %v, want [run1 run2] (arrival order)", got)
+	}
+}